@@ -0,0 +1,209 @@
+package chunker
+
+import (
+	"hash"
+	"io"
+)
+
+// windowSize is the width, in bytes, of the sliding window used by the
+// Rabin rolling hash.
+const windowSize = 64
+
+// DefaultPol is the irreducible polynomial used when a caller does not
+// have one of their own. It mirrors the constant restic ships with.
+const DefaultPol uint64 = 0x3DA3358B4DC173
+
+// ManifestEntry describes one piece of a variable-size chunk manifest, as
+// produced ahead of time by a content-defined chunking (CDC) tool. Offset
+// and Length describe where the piece lands in the reassembled stream.
+type ManifestEntry struct {
+	Hash   string
+	Offset int64
+	Length int
+}
+
+// cdcState carries the rolling-hash machinery and in-progress candidate
+// buffer for a Chunker built with NewCDCChunker.
+type cdcState struct {
+	tables *rabinTables
+
+	min int
+	avg int
+	max int
+	pol uint64
+
+	window [windowSize]byte
+	wpos   int
+	h      uint64
+
+	candidate []byte
+}
+
+// rabinTables holds the precomputed lookup tables for the 64-byte window
+// polynomial fingerprint: out[b] cancels the contribution of the byte
+// leaving the window, mod[b] reduces the degree-(polDeg+7) value produced
+// by shifting a new byte in, keyed by the bits above polDeg. polDeg is the
+// degree of pol itself, not a fixed register width — pol need not (and
+// for the default, does not) occupy all 64 bits.
+type rabinTables struct {
+	pol    uint64
+	polDeg int
+	out    [256]uint64
+	mod    [256]uint64
+}
+
+func gf2Deg(x uint64) int {
+	d := -1
+	for x != 0 {
+		d++
+		x >>= 1
+	}
+	return d
+}
+
+// rollIn shifts byte b into h and fully reduces the result modulo pol.
+// It is only used to build the tables below; the hot rolling path uses
+// rabinTables.roll instead.
+func rollIn(h uint64, b byte, pol uint64) uint64 {
+	h = (h << 8) | uint64(b)
+	return fullReduce(h, pol)
+}
+
+// fullReduce reduces an arbitrary GF(2) polynomial value x modulo pol.
+func fullReduce(x, pol uint64) uint64 {
+	polDeg := gf2Deg(pol)
+	for gf2Deg(x) >= polDeg {
+		x ^= pol << uint(gf2Deg(x)-polDeg)
+	}
+	return x
+}
+
+func newRabinTables(pol uint64) *rabinTables {
+	polDeg := gf2Deg(pol)
+	t := &rabinTables{pol: pol, polDeg: polDeg}
+	// out[b] = fingerprint of byte b followed by windowSize zero bytes,
+	// i.e. the contribution b still carries once windowSize more bytes
+	// have shifted in after it — exactly what must be cancelled out when
+	// b reaches the trailing edge of the window.
+	for b := 0; b < 256; b++ {
+		h := rollIn(0, byte(b), pol)
+		for i := 0; i < windowSize; i++ {
+			h = rollIn(h, 0, pol)
+		}
+		t.out[b] = h
+	}
+	// mod[idx] reduces idx*x^polDeg mod pol, where idx is the up-to-8 bits
+	// that land above polDeg after shifting a fully-reduced h left by 8
+	// and ORing in the new byte.
+	for b := 0; b < 256; b++ {
+		t.mod[b] = fullReduce(uint64(b)<<uint(polDeg), pol)
+	}
+	return t
+}
+
+// roll folds in the new byte b and cancels out the byte (old) leaving the
+// window, returning the fingerprint of the current windowSize-byte
+// window in O(1) table lookups.
+func (t *rabinTables) roll(h uint64, b, old byte) uint64 {
+	unreduced := (h << 8) | uint64(b)
+	idx := byte(unreduced >> uint(t.polDeg))
+	loMask := (uint64(1) << uint(t.polDeg)) - 1
+	h = (unreduced & loMask) ^ t.mod[idx]
+	h ^= t.out[old]
+	return h
+}
+
+// NewCDCChunker builds a Chunker whose piece boundaries were produced by a
+// content-defined chunking tool rather than fixed-size cuts. manifest must
+// list pieces in stream order; pol is the irreducible polynomial to use
+// for the rolling hash (DefaultPol if the caller has no preference), and
+// min/avg/max bound how small, how frequent, and how large a cut can be,
+// in bytes. hashFunc verifies each assembled chunk against manifest's hash,
+// mirroring NewChunker.
+func NewCDCChunker(manifest []ManifestEntry, pol uint64, min, avg, max int, hashFunc func() hash.Hash, out io.Writer) (*Chunker, error) {
+	hashList := make([]string, len(manifest))
+	for i, m := range manifest {
+		hashList[i] = m.Hash
+	}
+	fileSize := 0
+	if len(manifest) > 0 {
+		last := manifest[len(manifest)-1]
+		fileSize = int(last.Offset) + last.Length
+	}
+	c, err := NewChunker(hashList, avg, fileSize, hashFunc, out)
+	if err != nil {
+		return nil, err
+	}
+	for i, m := range manifest {
+		c.chunks[i].offset = m.Offset
+		c.chunks[i].length = m.Length
+	}
+	c.cdc = &cdcState{
+		tables: newRabinTables(pol),
+		min:    min,
+		avg:    avg,
+		max:    max,
+		pol:    pol,
+	}
+	return c, nil
+}
+
+// flushCDC applies whatever trailing bytes writeCDC never reached a cut
+// point for — the last piece of a stream almost never lands exactly on
+// an average-triggered boundary, so it must be flushed explicitly once
+// the caller knows no more data is coming.
+func (c *Chunker) flushCDC() error {
+	s := c.cdc
+	if len(s.candidate) == 0 {
+		return nil
+	}
+	if _, err := c.Apply(s.candidate); err != nil {
+		return err
+	}
+	s.candidate = nil
+	s.h = 0
+	s.wpos = 0
+	s.window = [windowSize]byte{}
+	return nil
+}
+
+// writeCDC feeds incoming bytes through the rolling hash, carving the
+// stream into chunks at each cut point and dispatching them to Apply once
+// a full candidate chunk has been assembled.
+func (c *Chunker) writeCDC(p []byte) (n int, err error) {
+	s := c.cdc
+	mask := uint64(1)<<uint(avgBits(s.avg)) - 1
+	for _, b := range p {
+		s.candidate = append(s.candidate, b)
+
+		old := s.window[s.wpos]
+		s.window[s.wpos] = b
+		s.wpos = (s.wpos + 1) % windowSize
+		s.h = s.tables.roll(s.h, b, old)
+
+		cut := len(s.candidate) >= s.max
+		if len(s.candidate) >= s.min && s.h&mask == 0 {
+			cut = true
+		}
+		if cut {
+			if _, err := c.Apply(s.candidate); err != nil {
+				return n, err
+			}
+			s.candidate = nil
+			s.h = 0
+			s.wpos = 0
+			s.window = [windowSize]byte{}
+		}
+	}
+	return len(p), nil
+}
+
+// avgBits returns the number of low bits of h that must be zero for a cut
+// to trigger, on average, every avg bytes.
+func avgBits(avg int) uint {
+	bits := uint(0)
+	for 1<<bits < avg {
+		bits++
+	}
+	return bits
+}
@@ -0,0 +1,206 @@
+package chunker
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"math/rand"
+	"testing"
+)
+
+// fromScratchWindow computes the fingerprint of the last min(windowSize,
+// i+1) bytes ending at position i by rolling them in one at a time from
+// h=0 — the unambiguous ground truth for "fingerprint of the current
+// window", independent of the incremental out/mod table machinery.
+func fromScratchWindow(data []byte, i int, pol uint64) uint64 {
+	start := i - windowSize + 1
+	if start < 0 {
+		start = 0
+	}
+	h := uint64(0)
+	for _, b := range data[start : i+1] {
+		h = rollIn(h, b, pol)
+	}
+	return h
+}
+
+func TestRabinTablesMatchFromScratch(t *testing.T) {
+	pol := DefaultPol
+	tables := newRabinTables(pol)
+	r := rand.New(rand.NewSource(1))
+	data := make([]byte, 2000)
+	r.Read(data)
+
+	var window [windowSize]byte
+	wpos := 0
+	h := uint64(0)
+	for i, b := range data {
+		old := window[wpos]
+		window[wpos] = b
+		wpos = (wpos + 1) % windowSize
+		h = tables.roll(h, b, old)
+
+		want := fromScratchWindow(data, i, pol)
+		if h != want {
+			t.Fatalf("i=%d incremental=%x fromScratch=%x", i, h, want)
+		}
+	}
+}
+
+// TestRabinCutPointsStableUnderEdit is the point of content-defined
+// chunking: inserting or deleting bytes in one region of the stream must
+// not reshuffle cut points far away from the edit.
+func TestRabinCutPointsStableUnderEdit(t *testing.T) {
+	const (
+		min = 256
+		avg = 1024
+		max = 8192
+	)
+	r := rand.New(rand.NewSource(2))
+	data := make([]byte, 64*1024)
+	r.Read(data)
+
+	cut := func(data []byte) []int {
+		tables := newRabinTables(DefaultPol)
+		var window [windowSize]byte
+		wpos := 0
+		h := uint64(0)
+		mask := uint64(1)<<avgBits(avg) - 1
+		var cuts []int
+		start := 0
+		for i, b := range data {
+			old := window[wpos]
+			window[wpos] = b
+			wpos = (wpos + 1) % windowSize
+			h = tables.roll(h, b, old)
+
+			length := i - start + 1
+			if length >= max || (length >= min && h&mask == 0) {
+				cuts = append(cuts, i+1)
+				start = i + 1
+				h = 0
+				wpos = 0
+				window = [windowSize]byte{}
+			}
+		}
+		return cuts
+	}
+
+	before := cut(data)
+	if len(before) < 2 {
+		t.Fatalf("expected multiple cut points in %d bytes, got %d", len(data), len(before))
+	}
+
+	// Insert a handful of bytes well past the first cut point, then check
+	// that the cuts before the edit are unaffected.
+	editAt := before[0] + 100
+	edited := make([]byte, 0, len(data)+8)
+	edited = append(edited, data[:editAt]...)
+	edited = append(edited, []byte("inserted")...)
+	edited = append(edited, data[editAt:]...)
+
+	after := cut(edited)
+
+	var beforeEdit []int
+	for _, c := range before {
+		if c <= editAt {
+			beforeEdit = append(beforeEdit, c)
+		}
+	}
+	var afterEdit []int
+	for _, c := range after {
+		if c <= editAt {
+			afterEdit = append(afterEdit, c)
+		}
+	}
+	if !intSlicesEqual(beforeEdit, afterEdit) {
+		t.Fatalf("cut points before the edit changed: before=%v after=%v", beforeEdit, afterEdit)
+	}
+
+	// Cut points past the edit must reappear in the edited stream, shifted
+	// by exactly the number of inserted bytes.
+	afterSet := make(map[int]bool, len(after))
+	for _, c := range after {
+		afterSet[c] = true
+	}
+	shift := len("inserted")
+	for _, c := range before {
+		if c > editAt && !afterSet[c+shift] {
+			t.Fatalf("cut point %d past the edit did not reappear at %d: before=%v after=%v", c, c+shift, before, after)
+		}
+	}
+}
+
+func intSlicesEqual(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// TestNewCDCChunkerAssemblesManifestPieces checks the end-to-end path: a
+// manifest whose boundaries were produced by an independent CDC pass
+// (the cut() logic above, not writeCDC's bookkeeping) must still verify
+// and flush correctly once replayed through Write/Apply.
+func TestNewCDCChunkerAssemblesManifestPieces(t *testing.T) {
+	const (
+		min = 256
+		avg = 1024
+		max = 8192
+	)
+	r := rand.New(rand.NewSource(3))
+	data := make([]byte, 32*1024)
+	r.Read(data)
+
+	var manifest []ManifestEntry
+	{
+		tables := newRabinTables(DefaultPol)
+		var window [windowSize]byte
+		wpos := 0
+		h := uint64(0)
+		mask := uint64(1)<<avgBits(avg) - 1
+		start := 0
+		for i, b := range data {
+			old := window[wpos]
+			window[wpos] = b
+			wpos = (wpos + 1) % windowSize
+			h = tables.roll(h, b, old)
+
+			length := i - start + 1
+			if length >= max || (length >= min && h&mask == 0) {
+				piece := data[start : i+1]
+				sum := sha1.Sum(piece)
+				manifest = append(manifest, ManifestEntry{Hash: string(sum[:]), Offset: int64(start), Length: len(piece)})
+				start = i + 1
+				h = 0
+				wpos = 0
+				window = [windowSize]byte{}
+			}
+		}
+		if start < len(data) {
+			piece := data[start:]
+			sum := sha1.Sum(piece)
+			manifest = append(manifest, ManifestEntry{Hash: string(sum[:]), Offset: int64(start), Length: len(piece)})
+		}
+	}
+
+	var out bytes.Buffer
+	c, err := NewCDCChunker(manifest, DefaultPol, min, avg, max, sha1.New, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(data); err != nil {
+		t.Fatalf("write err: %v", err)
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatalf("flush err: %v", err)
+	}
+	<-c.DoneNotify()
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatalf("output mismatch: got %d bytes, want %d bytes", out.Len(), len(data))
+	}
+}
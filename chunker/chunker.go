@@ -1,13 +1,11 @@
 package chunker
 
 import (
-	"crypto/sha1"
 	"errors"
 	"fmt"
 	"github.com/polvi/bt/bitset"
 	"hash"
 	"io"
-	"io/ioutil"
 	"os"
 	"strconv"
 	"sync"
@@ -16,117 +14,228 @@ import (
 type Chunker struct {
 	sync.RWMutex
 
-	Done           chan *os.File
-	hasher         hash.Hash
+	Done           chan struct{}
+	hashFunc       func() hash.Hash
+	merkle         bool
 	bitfield       *bitset.Bitset
 	chunks         []*Chunk
 	chunksDone     int
 	chunksTotal    int
-	file           *os.File
+	store          *segmentStore
 	chunkSize      int
 	fileSize       int
 	nextWritePiece int
-	out            io.Writer
+	out            io.Writer // optional tee; also pushed to spill once a reader attaches
 
-	buf        []byte
-	bytes_left int
+	readMu       sync.Mutex
+	readCond     *sync.Cond
+	spill        *spillBuffer
+	readDone     bool
+	readAttached bool // set by the first Read call; see writeOut
+
+	buf         []byte
+	bytes_left  int
+	maxBuffered int
+
+	// cdc holds the rolling-hash state when this Chunker was built with
+	// NewCDCChunker. It is nil for fixed-size Chunkers.
+	cdc *cdcState
+
+	// jobs and flushCond are set by NewChunkerWithWorkers. jobs is nil for
+	// a plain Chunker, which applies each piece synchronously instead.
+	jobs      chan []byte
+	flushCond *sync.Cond
+
+	// errs delivers async failures from the worker pool (a piece that
+	// fails to match any chunk, or a WriteAt error) to Errors(), since
+	// applyParallel runs after Write has already returned. Nil for a
+	// plain Chunker, which reports such failures synchronously instead.
+	errs chan error
 }
 
 type Chunk struct {
 	hash    string
 	applied bool
+	offset  int64
+	length  int
+}
+
+func NewChunker(hashList []string, chunkSize int, fileSize int, hashFunc func() hash.Hash, out io.Writer) (*Chunker, error) {
+	return NewChunkerWithSegmentSize(hashList, chunkSize, fileSize, DefaultSegmentSize, hashFunc, out)
 }
 
-func NewChunker(hashList []string, chunkSize int, fileSize int, out io.Writer) (*Chunker, error) {
+// NewChunkerWithSegmentSize is like NewChunker but lets the caller pick the
+// size of each backing segment file instead of DefaultSegmentSize.
+func NewChunkerWithSegmentSize(hashList []string, chunkSize int, fileSize int, segmentSize int, hashFunc func() hash.Hash, out io.Writer) (*Chunker, error) {
 	c := new(Chunker)
-	file, err := ioutil.TempFile("", "chunker")
+	c.hashFunc = hashFunc
+	store, err := newSegmentStore(fileSize, segmentSize)
 	if err != nil {
 		return nil, err
 	}
-	err = file.Truncate(int64(fileSize))
-	if err != nil {
-		return nil, err
-	}
-	c.file = file
+	c.store = store
 	c.chunksDone = 0
 	c.chunksTotal = len(hashList)
 	c.chunks = make([]*Chunk, len(hashList))
 	for i, h := range hashList {
+		offset := int64(i) * int64(chunkSize)
+		length := chunkSize
+		if offset+int64(length) > int64(fileSize) {
+			length = fileSize - int(offset)
+		}
 		c.chunks[i] = &Chunk{
 			hash:    h,
 			applied: false,
+			offset:  offset,
+			length:  length,
 		}
 	}
 	c.chunkSize = chunkSize
 	c.fileSize = fileSize
 	c.nextWritePiece = 0
 	c.out = out
-	c.buf = []byte{}
+	c.buf = GetChunkBuf(0)
 	c.bytes_left = c.fileSize
-	c.Done = make(chan *os.File, 1)
+	c.Done = make(chan struct{}, 1)
 	c.bitfield = bitset.NewBitset(len(hashList))
+	c.spill = newSpillBuffer(DefaultRingSize)
+	c.readCond = sync.NewCond(&c.readMu)
 	return c, nil
 }
 
+// Read implements io.Reader over the in-order piece stream: it blocks
+// until the next already-flushed bytes are available, copying them out of
+// the ring/spill buffer that Apply's in-order flush feeds, and returns
+// io.EOF once every piece has been applied and the buffer has drained.
+// Calling Read at least once is what opts a Chunker into pull-mode
+// buffering; see writeOut.
 func (c *Chunker) Read(p []byte) (n int, err error) {
-	/*
-		n, err = c.bufReader.Read(p)
-		if err != nil {
-			return n, err
-		}
-		if c.completed == len(c.hashMap) {
-			return n, io.EOF
-		}
-	*/
-	return 0, nil
+	c.readMu.Lock()
+	c.readAttached = true
+	for c.spill.Len() == 0 && !c.readDone {
+		c.readCond.Wait()
+	}
+	n, err = c.spill.Read(p)
+	drained := c.readDone && c.spill.Len() == 0
+	c.readMu.Unlock()
+	if err != nil {
+		return n, err
+	}
+	if n == 0 && drained {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// ErrBackpressure is returned by Write when the accumulation buffer is
+// already at the SetMaxBufferedBytes limit. The buffer only shrinks inside
+// Write and Flush, so nothing drains it between calls: retrying with the
+// same p is rejected again, and only a shorter p can fit.
+var ErrBackpressure = errors.New("chunker: write would exceed max buffered bytes")
+
+// SetMaxBufferedBytes caps how many bytes Write will accumulate in its
+// internal buffer before returning ErrBackpressure, so a fast peer
+// feeding a slow disk can't grow a Chunker's memory without bound. A
+// limit of 0 (the default) leaves the buffer unbounded.
+func (c *Chunker) SetMaxBufferedBytes(n int) {
+	c.maxBuffered = n
 }
 
 // Write provides a io.Writer interface for applying chunks.
 // Note that the beginningio.Reader must be aligned with a valid chunk.
 // Use Flush() to write final set of data out
 func (c *Chunker) Write(p []byte) (n int, err error) {
+	if c.cdc != nil {
+		return c.writeCDC(p)
+	}
+	if c.maxBuffered > 0 && len(c.buf)+len(p) > c.maxBuffered {
+		return 0, ErrBackpressure
+	}
 	c.buf = append(c.buf, p...)
 	if c.chunkSize >= c.fileSize && c.fileSize == len(c.buf) {
-		n, err = c.Apply(p)
+		n, err = c.applyOrEnqueue(p)
 		if err != nil {
 			fmt.Println("1")
 			return n, err
 		}
+		c.decrementBytesLeft(n)
 		return len(p), err
 	}
-	for c.bytes_left > 0 && len(c.buf) > c.chunkSize {
+	for c.bytesLeft() > 0 && len(c.buf) > c.chunkSize {
 		b := c.buf[:c.chunkSize]
-		n, err = c.Apply(b)
+		n, err = c.applyOrEnqueue(b)
 		if err != nil {
 			fmt.Println("2")
 			return n, err
 		}
 		c.buf = c.buf[c.chunkSize:]
+		c.decrementBytesLeft(n)
 	}
-	if c.bytes_left < c.chunkSize && len(c.buf) == c.bytes_left {
-		n, err = c.Apply(c.buf)
+	if bytesLeft := c.bytesLeft(); bytesLeft < c.chunkSize && len(c.buf) == bytesLeft {
+		n, err = c.applyOrEnqueue(c.buf)
 		if err != nil {
 			return n, err
 		}
-		c.buf = []byte{}
+		c.decrementBytesLeft(n)
+		FreeChunkBuf(c.buf)
+		c.buf = GetChunkBuf(0)
 		return len(p), nil
 	}
 	return len(p), nil
 }
 func (c *Chunker) Flush() (err error) {
-	_, err = c.Apply(c.buf)
+	if c.cdc != nil {
+		return c.flushCDC()
+	}
+	n, err := c.applyOrEnqueue(c.buf)
 	if err != nil {
 		return err
 	}
-	c.buf = []byte{}
+	c.decrementBytesLeft(n)
+	FreeChunkBuf(c.buf)
+	c.buf = GetChunkBuf(0)
 	return nil
 }
 
-func (c *Chunker) DoneNotify() chan *os.File {
+func (c *Chunker) DoneNotify() chan struct{} {
 	return c.Done
 }
-func (c *Chunker) GetFile() *os.File {
-	return c.file
+
+// bytesLeft reads c.bytes_left under the Chunker's lock.
+func (c *Chunker) bytesLeft() int {
+	c.RLock()
+	defer c.RUnlock()
+	return c.bytes_left
+}
+
+// decrementBytesLeft records that n more bytes of the file have been
+// handed off to applyOrEnqueue. It runs synchronously in Write/Flush, at
+// dispatch time rather than completion time, so bytes_left always
+// reflects how much of the file Write still has left to see — for a
+// worker-pool Chunker, applyParallel's hashing and verification of an
+// already-dispatched piece happens later and concurrently, and Write's
+// own loop conditions must not wait on that to find the file's tail.
+func (c *Chunker) decrementBytesLeft(n int) {
+	c.Lock()
+	c.bytes_left -= n
+	c.Unlock()
+}
+
+// Errors returns the channel async worker-pool failures are delivered on
+// (a piece that never matches a chunk, or a disk write/read error). It is
+// nil for a plain Chunker, which instead returns such errors directly
+// from Write/Apply. A full channel drops the failure rather than
+// blocking a worker; callers that care should drain it promptly.
+func (c *Chunker) Errors() <-chan error {
+	return c.errs
+}
+
+// GetSegments returns the backing segment files in stream order. Piece i
+// lives at its chunk's offset into the logical stream they form (i*chunkSize
+// for a fixed-size Chunker, the manifest offset for NewCDCChunker), which
+// may span two adjacent segments.
+func (c *Chunker) GetSegments() []*os.File {
+	return c.store.segments
 }
 
 func (c *Chunker) findChunk(hash string) (*Chunk, int, error) {
@@ -144,13 +253,25 @@ func (c *Chunker) GetBitfield() *bitset.Bitset {
 	return c.bitfield
 }
 
+// digest returns the expected-hash comparison key for a candidate chunk.
+// Flat Chunkers hash the whole chunk with hashFunc; merkle Chunkers build a
+// per-piece Merkle tree over 16 KiB leaves instead, so a piece whose leaves
+// don't reconstruct the root is rejected even if some other digest of it
+// happens to match.
+func (c *Chunker) digest(b []byte) string {
+	if c.merkle {
+		return merkleRoot(b, merkleLeafSize)
+	}
+	h := c.hashFunc()
+	h.Write(b)
+	return string(h.Sum(nil))
+}
+
 func (c *Chunker) Apply(b []byte) (int, error) {
 	if len(b) == 0 {
 		return 0, nil
 	}
-	hasher := sha1.New()
-	hasher.Write(b)
-	sum := string(hasher.Sum(nil))
+	sum := c.digest(b)
 
 	c.Lock()
 	defer c.Unlock()
@@ -163,18 +284,16 @@ func (c *Chunker) Apply(b []byte) (int, error) {
 		// we already wrote it, no op
 		return 0, nil
 	}
-	n, err := c.file.WriteAt(b, int64(piece*c.chunkSize))
+	n, err := c.store.WriteAt(b, chunk.offset)
 	if err != nil {
 		return n, err
 	}
 	chunk.applied = true
 	c.bitfield.Set(piece)
-	c.bytes_left -= n
 
 	c.chunksDone += 1
 	if c.nextWritePiece == piece {
-		_, err := c.out.Write(b)
-		if err != nil {
+		if err := c.writeOut(b); err != nil {
 			return n, err
 		}
 		c.nextWritePiece++
@@ -186,15 +305,18 @@ func (c *Chunker) Apply(b []byte) (int, error) {
 		}
 		if j > c.nextWritePiece {
 			// read everything between these chunks and write it all at once
-			buf := make([]byte, ((j - c.nextWritePiece) * c.chunkSize))
-			n2, err := c.file.ReadAt(buf, int64(c.chunkSize*c.nextWritePiece))
+			start := c.chunks[c.nextWritePiece].offset
+			end := c.chunks[j-1].offset + int64(c.chunks[j-1].length)
+			buf := GetChunkBuf(int(end - start))
+			n2, err := c.store.ReadAt(buf, start)
 			if err == io.EOF {
 				buf = buf[:n2]
 			}
 			if err != nil && err != io.EOF {
 				return n, err
 			}
-			_, err = c.out.Write(buf)
+			err = c.writeOut(buf)
+			FreeChunkBuf(buf)
 			if err != nil {
 				return n, err
 			}
@@ -202,18 +324,50 @@ func (c *Chunker) Apply(b []byte) (int, error) {
 		c.nextWritePiece = j
 	}
 	if c.chunksDone == c.chunksTotal {
-		c.file.Sync()
-		c.Done <- c.file
+		if err := c.store.truncateTail(); err != nil {
+			return n, err
+		}
+		c.store.Sync()
+		c.readMu.Lock()
+		c.readDone = true
+		c.readCond.Broadcast()
+		c.readMu.Unlock()
+		c.Done <- struct{}{}
 	}
 	return n, nil
 }
 
+// writeOut pushes in-order bytes to the optional tee (push-mode callers)
+// and to the spill buffer that backs Read (pull-mode callers), waking any
+// goroutine blocked in Read. A caller that only set out and never calls
+// Read already has every byte via the tee, so bytes are only buffered for
+// Read once something has actually called it at least once — otherwise
+// every push-mode write past DefaultRingSize would needlessly spill a
+// second copy to disk that nothing ever drains.
+func (c *Chunker) writeOut(b []byte) error {
+	if c.out != nil {
+		if _, err := c.out.Write(b); err != nil {
+			return err
+		}
+	}
+	c.readMu.Lock()
+	if c.out != nil && !c.readAttached {
+		c.readMu.Unlock()
+		return nil
+	}
+	_, err := c.spill.Write(b)
+	c.readCond.Broadcast()
+	c.readMu.Unlock()
+	return err
+}
+
 func (c *Chunker) Cleanup() error {
-	if err := c.file.Close(); err != nil {
+	FreeChunkBuf(c.buf)
+	if err := c.spill.Close(); err != nil {
 		return err
 	}
-	if err := os.Remove(c.file.Name()); err != nil {
+	if err := c.store.Close(); err != nil {
 		return err
 	}
-	return nil
+	return c.store.Remove()
 }
@@ -0,0 +1,67 @@
+package chunker
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func chunkerFixture(t *testing.T, out io.Writer) (*Chunker, []byte) {
+	const chunkSize = 16
+	data := workerTestData(chunkSize * 5)
+	var hashList []string
+	for off := 0; off < len(data); off += chunkSize {
+		sum := sha1.Sum(data[off : off+chunkSize])
+		hashList = append(hashList, string(sum[:]))
+	}
+	c, err := NewChunker(hashList, chunkSize, len(data), sha1.New, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, data
+}
+
+// TestWriteOutSkipsSpillWithoutReader checks that a push-only consumer (out
+// set, Read never called) doesn't pay for a second, never-drained copy of
+// every flushed byte in the spill buffer.
+func TestWriteOutSkipsSpillWithoutReader(t *testing.T) {
+	var out bytes.Buffer
+	c, data := chunkerFixture(t, &out)
+	if _, err := c.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	<-c.DoneNotify()
+
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatalf("tee mismatch: got %d bytes, want %d", out.Len(), len(data))
+	}
+	if n := c.spill.Len(); n != 0 {
+		t.Fatalf("expected nothing buffered for Read, got %d bytes in spill", n)
+	}
+}
+
+// TestReadDrainsInOrderStreamAndEOFs checks pull-mode semantics: Read
+// returns exactly the reassembled stream in order and terminates with EOF
+// once every piece has landed.
+func TestReadDrainsInOrderStreamAndEOFs(t *testing.T) {
+	c, data := chunkerFixture(t, nil)
+	if _, err := c.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatalf("read err: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("read mismatch: got %d bytes, want %d", len(got), len(data))
+	}
+}
@@ -0,0 +1,66 @@
+package chunker
+
+import (
+	"crypto/sha256"
+	"io"
+)
+
+// merkleLeafSize is the BEP 52 leaf size: v2 torrents verify a piece by
+// hashing it in 16 KiB blocks and folding the results into a binary tree,
+// rather than hashing the piece as one flat block.
+const merkleLeafSize = 16 * 1024
+
+// NewMerkleChunker builds a Chunker for BitTorrent v2 (BEP 52) style
+// pieces. hashList holds the expected Merkle root of each piece; a piece
+// is accepted only if reconstructing the tree over its 16 KiB SHA-256
+// leaves produces that root, so a piece whose leaves don't reconstruct
+// the root is rejected even if some other digest of it happens to match.
+func NewMerkleChunker(hashList []string, chunkSize int, fileSize int, out io.Writer) (*Chunker, error) {
+	c, err := NewChunker(hashList, chunkSize, fileSize, sha256.New, out)
+	if err != nil {
+		return nil, err
+	}
+	c.merkle = true
+	return c, nil
+}
+
+// merkleRoot hashes b in leafSize-byte leaves with SHA-256, pads the leaf
+// level with the hash of an all-zero leafSize block up to the next power
+// of two (BEP 52's convention for an unbalanced tree, e.g. a piece whose
+// last block is shorter than leafSize), and folds pairwise up to a single
+// root.
+func merkleRoot(b []byte, leafSize int) string {
+	if len(b) == 0 {
+		sum := sha256.Sum256(nil)
+		return string(sum[:])
+	}
+	var level [][]byte
+	for off := 0; off < len(b); off += leafSize {
+		end := off + leafSize
+		if end > len(b) {
+			end = len(b)
+		}
+		sum := sha256.Sum256(b[off:end])
+		level = append(level, sum[:])
+	}
+	padSum := sha256.Sum256(make([]byte, leafSize))
+	pad := padSum[:]
+	for !isPowerOfTwo(len(level)) {
+		level = append(level, pad)
+	}
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			h := sha256.New()
+			h.Write(level[i])
+			h.Write(level[i+1])
+			next = append(next, h.Sum(nil))
+		}
+		level = next
+	}
+	return string(level[0])
+}
+
+func isPowerOfTwo(n int) bool {
+	return n > 0 && n&(n-1) == 0
+}
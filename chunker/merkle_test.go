@@ -0,0 +1,52 @@
+package chunker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+// TestMerkleRootUnbalancedTreePadsWithZeroLeaf checks merkleRoot against an
+// independently computed BEP 52 reference value for a piece whose block
+// count (3) isn't a power of two: two full 16 KiB leaves and one short
+// (8 KiB) leaf, padded with the hash of an all-zero 16 KiB block up to 4
+// leaves before folding. The expected root was computed by a separate
+// Python implementation of the same padding rule, not by calling
+// merkleRoot itself.
+func TestMerkleRootUnbalancedTreePadsWithZeroLeaf(t *testing.T) {
+	const wantHex = "9d737d3e53fbbb745395dfe2e1b34099013468b9b655b3cc8fec22b454a7c8cc"
+	want, err := hex.DecodeString(wantHex)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var piece []byte
+	piece = append(piece, bytes.Repeat([]byte{1}, merkleLeafSize)...)
+	piece = append(piece, bytes.Repeat([]byte{2}, merkleLeafSize)...)
+	piece = append(piece, bytes.Repeat([]byte{3}, merkleLeafSize/2)...)
+
+	got := []byte(merkleRoot(piece, merkleLeafSize))
+	if !bytes.Equal(got, want) {
+		t.Fatalf("merkleRoot = %x, want %x", got, want)
+	}
+}
+
+// TestMerkleRootBalancedTreeNeedsNoPadding checks the already-power-of-two
+// case (2 leaves) still folds directly with no padding involved.
+func TestMerkleRootBalancedTreeNeedsNoPadding(t *testing.T) {
+	piece := append(bytes.Repeat([]byte{1}, merkleLeafSize), bytes.Repeat([]byte{2}, merkleLeafSize)...)
+	got := merkleRoot(piece, merkleLeafSize)
+	left := sha256.Sum256(piece[:merkleLeafSize])
+	right := sha256.Sum256(piece[merkleLeafSize:])
+	direct := sha256.Sum256(append(left[:], right[:]...))
+	if got != string(direct[:]) {
+		t.Fatalf("merkleRoot = %x, want the unpadded fold %x", got, direct)
+	}
+	if len(got) != 32 {
+		t.Fatalf("expected a 32-byte SHA-256 root, got %d bytes", len(got))
+	}
+	if got != merkleRoot(piece, merkleLeafSize) {
+		t.Fatal("merkleRoot is not deterministic")
+	}
+}
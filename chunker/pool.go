@@ -0,0 +1,31 @@
+package chunker
+
+import "sync"
+
+// DefaultChunkBufSize seeds pooled buffers at a size large enough to hold
+// one piece of a typical torrent without a grow-and-copy.
+const DefaultChunkBufSize = 256 * 1024
+
+// bufPool recycles the byte slices used for Write's accumulation buffer
+// and Apply's in-order flush buffer, so a Chunker handling many pieces
+// doesn't allocate a fresh slice per chunk.
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, 0, DefaultChunkBufSize)
+	},
+}
+
+// GetChunkBuf returns a pooled byte slice with length n, allocating a
+// fresh one only if the pooled buffer's capacity is too small.
+func GetChunkBuf(n int) []byte {
+	b := bufPool.Get().([]byte)
+	if cap(b) < n {
+		return make([]byte, n)
+	}
+	return b[:n]
+}
+
+// FreeChunkBuf returns b to the pool for reuse.
+func FreeChunkBuf(b []byte) {
+	bufPool.Put(b[:0])
+}
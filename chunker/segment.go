@@ -0,0 +1,142 @@
+package chunker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// DefaultSegmentSize is the size of each backing segment file. Following
+// Prometheus's chunk-file segmentation, a multi-hundred-GB torrent is
+// stored as a directory of fixed-size files instead of one giant sparse
+// temp file, so the download isn't pinned to a single filesystem.
+const DefaultSegmentSize = 512 * 1024 * 1024
+
+// segmentStore is an io.ReaderAt/io.WriterAt view over a directory of
+// fixed-size segment files, addressed by byte offset in the logical
+// stream. Every segment is pre-allocated up front; the last one is
+// truncated to the true tail length once the transfer completes.
+type segmentStore struct {
+	dir         string
+	segmentSize int64
+	fileSize    int64
+	segments    []*os.File
+}
+
+func newSegmentStore(fileSize int, segmentSize int) (*segmentStore, error) {
+	if segmentSize <= 0 {
+		segmentSize = DefaultSegmentSize
+	}
+	dir, err := ioutil.TempDir("", "chunker")
+	if err != nil {
+		return nil, err
+	}
+	s := &segmentStore{dir: dir, segmentSize: int64(segmentSize), fileSize: int64(fileSize)}
+	n := s.numSegments()
+	for i := 0; i < n; i++ {
+		f, err := os.Create(filepath.Join(dir, fmt.Sprintf("%08d", i)))
+		if err != nil {
+			s.cleanup()
+			return nil, err
+		}
+		s.segments = append(s.segments, f)
+		// Every segment, including the last, is pre-allocated to the full
+		// segmentSize here; truncateTail is what shrinks the last one back
+		// down once the true length is known, on completion.
+		if err := f.Truncate(s.segmentSize); err != nil {
+			s.cleanup()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// cleanup closes whatever segment files newSegmentStore already opened
+// and removes the backing directory, so a failure partway through
+// pre-allocation (e.g. disk full) doesn't leak them.
+func (s *segmentStore) cleanup() {
+	for _, f := range s.segments {
+		f.Close()
+	}
+	os.RemoveAll(s.dir)
+}
+
+func (s *segmentStore) numSegments() int {
+	if s.fileSize == 0 {
+		return 1
+	}
+	n := s.fileSize / s.segmentSize
+	if s.fileSize%s.segmentSize != 0 {
+		n++
+	}
+	return int(n)
+}
+
+// span splits the byte range [off, off+len(b)) into the segment-local
+// calls needed to cover it, invoking do once per segment touched so a
+// chunk straddling a boundary is written or read in two (or more) pieces.
+func (s *segmentStore) span(off int64, b []byte, do func(f *os.File, b []byte, segOff int64) (int, error)) (int, error) {
+	total := 0
+	for len(b) > 0 {
+		idx := off / s.segmentSize
+		segOff := off % s.segmentSize
+		n := s.segmentSize - segOff
+		if n > int64(len(b)) {
+			n = int64(len(b))
+		}
+		written, err := do(s.segments[idx], b[:n], segOff)
+		total += written
+		if err != nil {
+			return total, err
+		}
+		b = b[n:]
+		off += n
+	}
+	return total, nil
+}
+
+func (s *segmentStore) WriteAt(b []byte, off int64) (int, error) {
+	return s.span(off, b, func(f *os.File, b []byte, segOff int64) (int, error) {
+		return f.WriteAt(b, segOff)
+	})
+}
+
+func (s *segmentStore) ReadAt(b []byte, off int64) (int, error) {
+	return s.span(off, b, func(f *os.File, b []byte, segOff int64) (int, error) {
+		return f.ReadAt(b, segOff)
+	})
+}
+
+func (s *segmentStore) Sync() error {
+	for _, f := range s.segments {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// truncateTail shrinks the last segment down to the true tail length,
+// undoing the pre-allocation once the logical fileSize is known to not be
+// an exact multiple of segmentSize.
+func (s *segmentStore) truncateTail() error {
+	tail := s.fileSize % s.segmentSize
+	if tail == 0 {
+		return nil
+	}
+	return s.segments[len(s.segments)-1].Truncate(tail)
+}
+
+func (s *segmentStore) Close() error {
+	for _, f := range s.segments {
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *segmentStore) Remove() error {
+	return os.RemoveAll(s.dir)
+}
@@ -0,0 +1,109 @@
+package chunker
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func segmentFileSize(t *testing.T, f *os.File) int64 {
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
+
+// TestNewSegmentStorePreAllocatesEverySegment checks that the last segment
+// is pre-allocated to the full segmentSize at creation time, not truncated
+// down to the tail length early -- truncateTail is the only thing that
+// should ever shrink it, and only once the caller says the transfer is
+// done.
+func TestNewSegmentStorePreAllocatesEverySegment(t *testing.T) {
+	const segmentSize = 100
+	s, err := newSegmentStore(250, segmentSize) // 3 segments: 100, 100, 50
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Remove()
+	defer s.Close()
+
+	if len(s.segments) != 3 {
+		t.Fatalf("expected 3 segments, got %d", len(s.segments))
+	}
+	for i, f := range s.segments {
+		if got := segmentFileSize(t, f); got != segmentSize {
+			t.Fatalf("segment %d: got size %d before truncateTail, want %d", i, got, segmentSize)
+		}
+	}
+
+	if err := s.truncateTail(); err != nil {
+		t.Fatal(err)
+	}
+	last := s.segments[len(s.segments)-1]
+	if got := segmentFileSize(t, last); got != 50 {
+		t.Fatalf("last segment after truncateTail: got size %d, want 50", got)
+	}
+}
+
+// TestSegmentStoreSpansBoundary checks that a write/read spanning two
+// segment files is stitched together transparently.
+func TestSegmentStoreSpansBoundary(t *testing.T) {
+	const segmentSize = 100
+	s, err := newSegmentStore(250, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Remove()
+	defer s.Close()
+
+	data := workerTestData(250)
+	if _, err := s.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// This range straddles the first segment boundary at offset 100.
+	buf := make([]byte, 40)
+	if _, err := s.ReadAt(buf, 80); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data[80:120]) {
+		t.Fatalf("boundary-straddling read mismatch: got %x, want %x", buf, data[80:120])
+	}
+
+	whole := make([]byte, 250)
+	if _, err := s.ReadAt(whole, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(whole, data) {
+		t.Fatal("full read back across all segments mismatch")
+	}
+}
+
+// TestSegmentStoreCleanupClosesFilesAndRemovesDir checks the helper
+// newSegmentStore calls when pre-allocation fails partway through (e.g.
+// disk full on a later segment): every segment file already opened must
+// be closed and the backing directory removed, so a failed construction
+// doesn't leak them.
+func TestSegmentStoreCleanupClosesFilesAndRemovesDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chunker-cleanup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(dir, "00000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &segmentStore{dir: dir, segments: []*os.File{f}}
+
+	s.cleanup()
+
+	if _, err := f.WriteString("x"); err == nil {
+		t.Fatal("expected the already-opened segment file to be closed")
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("expected the backing dir to be removed, stat err = %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package chunker
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// DefaultRingSize bounds how many bytes of already-flushed-but-unread
+// output a spillBuffer keeps in memory before spilling the overflow to a
+// secondary tempfile.
+const DefaultRingSize = 4 * 1024 * 1024
+
+// spillBuffer is a disk-buffer-reader style FIFO: writes land in a small
+// in-memory ring first; once the ring fills up, further writes spill to a
+// secondary tempfile and are read back from there on demand. This lets a
+// fast producer (Apply's in-order flush) run ahead of a slow consumer
+// (Read) without the Chunker's memory growing without bound.
+type spillBuffer struct {
+	mu sync.Mutex
+
+	ringSize int
+	ring     []byte // unread bytes kept in memory, FIFO
+
+	spill     *os.File // secondary tempfile, created lazily on first overflow
+	spillRPos int64    // next unread byte offset in spill
+	spillWPos int64    // next write offset in spill
+}
+
+func newSpillBuffer(ringSize int) *spillBuffer {
+	if ringSize <= 0 {
+		ringSize = DefaultRingSize
+	}
+	return &spillBuffer{ringSize: ringSize}
+}
+
+func (s *spillBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	total := len(p)
+	// Once the spill file holds unread bytes, every new write must keep
+	// going to spill, even if Read has since freed up room in ring: the
+	// ring and spill file each preserve their own write order, but
+	// nothing orders them against each other, so back-filling the ring
+	// while spill still has a backlog would let a later write overtake
+	// an earlier one still queued on disk.
+	spillBacklogged := s.spill != nil && s.spillRPos < s.spillWPos
+	if !spillBacklogged {
+		if room := s.ringSize - len(s.ring); room > 0 {
+			n := room
+			if n > len(p) {
+				n = len(p)
+			}
+			s.ring = append(s.ring, p[:n]...)
+			p = p[n:]
+		}
+	}
+	if len(p) > 0 {
+		if s.spill == nil {
+			f, err := ioutil.TempFile("", "chunker-spill")
+			if err != nil {
+				return 0, err
+			}
+			s.spill = f
+		}
+		if _, err := s.spill.WriteAt(p, s.spillWPos); err != nil {
+			return 0, err
+		}
+		s.spillWPos += int64(len(p))
+	}
+	return total, nil
+}
+
+// Read drains up to len(p) unread bytes, pulling from the in-memory ring
+// first and falling back to the spill file once the ring is empty.
+func (s *spillBuffer) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := copy(p, s.ring)
+	s.ring = s.ring[n:]
+	if n < len(p) && s.spill != nil && s.spillRPos < s.spillWPos {
+		want := int64(len(p) - n)
+		if avail := s.spillWPos - s.spillRPos; want > avail {
+			want = avail
+		}
+		n2, err := s.spill.ReadAt(p[n:n+int(want)], s.spillRPos)
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		s.spillRPos += int64(n2)
+		n += n2
+	}
+	return n, nil
+}
+
+// Len reports how many unread bytes remain, across both the ring and the
+// spill file.
+func (s *spillBuffer) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.ring) + int(s.spillWPos-s.spillRPos)
+}
+
+func (s *spillBuffer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.spill == nil {
+		return nil
+	}
+	name := s.spill.Name()
+	if err := s.spill.Close(); err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
@@ -0,0 +1,39 @@
+package chunker
+
+import "testing"
+
+// TestSpillBufferPreservesFIFOAcrossRingAndSpill reproduces the ordering
+// bug directly: once data is queued in the spill file, a later write must
+// not be allowed to back-fill room freed up in the ring ahead of it, or
+// the reassembled stream comes out reordered.
+func TestSpillBufferPreservesFIFOAcrossRingAndSpill(t *testing.T) {
+	s := newSpillBuffer(10)
+
+	if _, err := s.Write([]byte("AAAAAAAAAA")); err != nil { // fills the ring
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("BBBBB")); err != nil { // ring full, spills
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 3)
+	if _, err := s.Read(buf); err != nil { // drains "AAA" off the ring front
+		t.Fatal(err)
+	}
+	if string(buf) != "AAA" {
+		t.Fatalf("first read = %q, want AAA", buf)
+	}
+
+	if _, err := s.Write([]byte("CCC")); err != nil { // must queue behind BBBBB, not fill the freed ring room
+		t.Fatal(err)
+	}
+
+	rest := make([]byte, 15)
+	n, err := s.Read(rest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(rest[:n]), "AAAAAAABBBBBCCC"; got != want {
+		t.Fatalf("reassembled stream = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,154 @@
+package chunker
+
+import (
+	"hash"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// NewChunkerWithWorkers is like NewChunker but hashes and writes pieces
+// concurrently across a pool of workers goroutines (runtime.NumCPU() if
+// workers <= 0), instead of serializing hashing (CPU) and WriteAt (disk
+// I/O) behind Apply's single lock. Only the bitfield update, chunksDone,
+// and the in-order flush are synchronized; WriteAt calls for different
+// pieces run in parallel since they target disjoint byte ranges. Done is
+// still signaled exactly once, by the dedicated flush goroutine.
+func NewChunkerWithWorkers(hashList []string, chunkSize int, fileSize int, hashFunc func() hash.Hash, workers int, out io.Writer) (*Chunker, error) {
+	c, err := NewChunker(hashList, chunkSize, fileSize, hashFunc, out)
+	if err != nil {
+		return nil, err
+	}
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	c.flushCond = sync.NewCond(&c.RWMutex)
+	c.jobs = make(chan []byte, workers*2)
+	c.errs = make(chan error, workers*2)
+	for i := 0; i < workers; i++ {
+		go c.worker()
+	}
+	go c.flushLoop()
+	return c, nil
+}
+
+// applyOrEnqueue hashes and writes b, either synchronously via Apply or,
+// for a Chunker built with NewChunkerWithWorkers, by handing a private
+// copy to the worker pool so hashing and disk I/O for different pieces
+// can overlap.
+func (c *Chunker) applyOrEnqueue(b []byte) (int, error) {
+	if c.jobs == nil {
+		return c.Apply(b)
+	}
+	cp := GetChunkBuf(len(b))
+	copy(cp, b)
+	c.jobs <- cp
+	return len(b), nil
+}
+
+func (c *Chunker) worker() {
+	for b := range c.jobs {
+		c.applyParallel(b)
+		FreeChunkBuf(b)
+	}
+}
+
+// applyParallel is Apply's worker-pool counterpart: hashing and WriteAt
+// run without holding the Chunker lock, since different pieces land at
+// disjoint byte ranges. Only the bitfield/chunksDone bookkeeping, which
+// flushLoop depends on, is synchronized. A piece that fails to match any
+// chunk or a disk error is reported on Errors() rather than dropped,
+// since applyOrEnqueue has already told Write's caller the bytes were
+// accepted.
+func (c *Chunker) applyParallel(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	sum := c.digest(b)
+
+	c.Lock()
+	chunk, piece, err := c.findChunk(sum)
+	c.Unlock()
+	if err != nil {
+		c.reportError(err)
+		return
+	}
+
+	if _, err := c.store.WriteAt(b, chunk.offset); err != nil {
+		c.reportError(err)
+		return
+	}
+
+	c.Lock()
+	if c.bitfield.IsSet(piece) {
+		// a duplicate arrival for the same piece raced us; no-op
+		c.Unlock()
+		return
+	}
+	chunk.applied = true
+	c.bitfield.Set(piece)
+	c.chunksDone++
+	c.flushCond.Broadcast()
+	c.Unlock()
+}
+
+// reportError delivers an async failure to Errors() without blocking the
+// worker: if nobody is draining it and the buffer is full, the failure is
+// dropped rather than stalling the pool.
+func (c *Chunker) reportError(err error) {
+	select {
+	case c.errs <- err:
+	default:
+	}
+}
+
+// flushLoop is the in-order flush side of the worker pool: it wakes up
+// whenever applyParallel sets a bit in the bitfield, and pushes out every
+// contiguous run of applied pieces starting at nextWritePiece. It exits,
+// finalizes the segment store, and signals Done exactly once, when
+// nextWritePiece reaches the end of the manifest.
+func (c *Chunker) flushLoop() {
+	c.Lock()
+	for c.nextWritePiece < len(c.chunks) {
+		for c.nextWritePiece < len(c.chunks) && !c.bitfield.IsSet(c.nextWritePiece) {
+			c.flushCond.Wait()
+		}
+		if c.nextWritePiece >= len(c.chunks) {
+			break
+		}
+		piece := c.nextWritePiece
+		j := piece
+		for j < len(c.chunks) && c.bitfield.IsSet(j) {
+			j++
+		}
+		start := c.chunks[piece].offset
+		end := c.chunks[j-1].offset + int64(c.chunks[j-1].length)
+		c.nextWritePiece = j
+		c.Unlock()
+
+		buf := GetChunkBuf(int(end - start))
+		n2, err := c.store.ReadAt(buf, start)
+		if err == io.EOF {
+			buf = buf[:n2]
+		} else if err != nil {
+			c.reportError(err)
+		}
+		if err := c.writeOut(buf); err != nil {
+			c.reportError(err)
+		}
+		FreeChunkBuf(buf)
+
+		c.Lock()
+	}
+	c.Unlock()
+
+	if err := c.store.truncateTail(); err != nil {
+		c.reportError(err)
+	}
+	c.store.Sync()
+	c.readMu.Lock()
+	c.readDone = true
+	c.readCond.Broadcast()
+	c.readMu.Unlock()
+	c.Done <- struct{}{}
+}
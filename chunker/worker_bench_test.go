@@ -0,0 +1,65 @@
+package chunker
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io/ioutil"
+	"testing"
+)
+
+const (
+	benchPieceSize  = 1 << 20 // 1 MiB
+	benchPieceCount = 64      // 64 MiB synthetic torrent
+)
+
+func benchManifest() ([]string, []byte) {
+	data := bytes.Repeat([]byte("x"), benchPieceSize*benchPieceCount)
+	hashList := make([]string, benchPieceCount)
+	for i := 0; i < benchPieceCount; i++ {
+		h := sha1.Sum(data[i*benchPieceSize : (i+1)*benchPieceSize])
+		hashList[i] = string(h[:])
+	}
+	return hashList, data
+}
+
+func BenchmarkChunkerSingleThreaded(b *testing.B) {
+	hashList, data := benchManifest()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		c, err := NewChunker(hashList, benchPieceSize, len(data), sha1.New, ioutil.Discard)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := c.Write(data); err != nil {
+			b.Fatal(err)
+		}
+		if err := c.Flush(); err != nil {
+			b.Fatal(err)
+		}
+		<-c.DoneNotify()
+		if err := c.Cleanup(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkChunkerWorkers(b *testing.B) {
+	hashList, data := benchManifest()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		c, err := NewChunkerWithWorkers(hashList, benchPieceSize, len(data), sha1.New, 0, ioutil.Discard)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := c.Write(data); err != nil {
+			b.Fatal(err)
+		}
+		if err := c.Flush(); err != nil {
+			b.Fatal(err)
+		}
+		<-c.DoneNotify()
+		if err := c.Cleanup(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package chunker
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// workerTestData returns n bytes of per-chunk-distinct random content, so
+// findChunk never has to disambiguate two pieces that legitimately share
+// a hash.
+func workerTestData(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(4)).Read(data)
+	return data
+}
+
+// TestWorkerPoolUnalignedWrite exercises Write/applyParallel with a chunk
+// size that does not evenly divide the file size, across several workers,
+// under -race: this is the shape that previously raced on bytes_left
+// between Write's loop conditions and applyParallel's locked update.
+func TestWorkerPoolUnalignedWrite(t *testing.T) {
+	const chunkSize = 300
+	data := workerTestData(1000)
+
+	var hashList []string
+	for off := 0; off < len(data); off += chunkSize {
+		end := off + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		sum := sha1.Sum(data[off:end])
+		hashList = append(hashList, string(sum[:]))
+	}
+
+	var out bytes.Buffer
+	c, err := NewChunkerWithWorkers(hashList, chunkSize, len(data), sha1.New, 4, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(data); err != nil {
+		t.Fatalf("write err: %v", err)
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatalf("flush err: %v", err)
+	}
+
+	select {
+	case <-c.DoneNotify():
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for Done")
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatalf("output mismatch: got %d bytes, want %d", out.Len(), len(data))
+	}
+}
+
+// TestWorkerPoolReportsVerificationFailure checks that a piece applyParallel
+// can't match against the manifest is surfaced on Errors(), rather than
+// only logged and dropped.
+func TestWorkerPoolReportsVerificationFailure(t *testing.T) {
+	const chunkSize = 300
+	data := workerTestData(1000)
+
+	var hashList []string
+	for off := 0; off < len(data); off += chunkSize {
+		end := off + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		sum := sha1.Sum(data[off:end])
+		hashList = append(hashList, string(sum[:]))
+	}
+
+	corrupted := make([]byte, len(data))
+	copy(corrupted, data)
+	corrupted[chunkSize] ^= 0xff // break the second piece's hash
+
+	var out bytes.Buffer
+	c, err := NewChunkerWithWorkers(hashList, chunkSize, len(data), sha1.New, 4, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(corrupted); err != nil {
+		t.Fatalf("write err: %v", err)
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatalf("flush err: %v", err)
+	}
+
+	select {
+	case err := <-c.Errors():
+		if err == nil {
+			t.Fatal("got nil error")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a reported verification failure")
+	}
+}